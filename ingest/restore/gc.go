@@ -0,0 +1,117 @@
+package restore
+
+import (
+	"database/sql"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// gcLifeTimeReassertInterval is how often GCLifeTimeGuard re-applies its
+// extended tikv_gc_life_time, in case another operator (or TiDB itself)
+// overwrote it in the meantime.
+const gcLifeTimeReassertInterval = time.Minute
+
+// GCLifeTimeGuard extends tikv_gc_life_time for the duration of a restore so
+// GC doesn't reclaim data the restore still needs, and guarantees the
+// original value is put back when the guard is closed — even if another
+// operator overwrote it mid-restore, or the process received SIGINT/SIGTERM.
+// Without this, an interrupted restore leaves GC disabled indefinitely.
+type GCLifeTimeGuard struct {
+	db       *sql.DB
+	original string
+	extended string
+
+	closeOnce sync.Once
+	stopCh    chan struct{}
+	doneCh    chan struct{}
+	sigCh     chan os.Signal
+}
+
+// NewGCLifeTimeGuard reads and stashes the current tikv_gc_life_time, sets it
+// to extended, and starts a background goroutine that periodically
+// re-asserts extended and restores the original value on SIGINT/SIGTERM.
+func NewGCLifeTimeGuard(db *sql.DB, extended string) (*GCLifeTimeGuard, error) {
+	original, err := ObtainGCLifeTime(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := UpdateGCLifeTime(db, extended); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	g := &GCLifeTimeGuard{
+		db:       db,
+		original: original,
+		extended: extended,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+		sigCh:    make(chan os.Signal, 1),
+	}
+
+	signal.Notify(g.sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go g.run()
+
+	return g, nil
+}
+
+func (g *GCLifeTimeGuard) run() {
+	defer close(g.doneCh)
+
+	ticker := time.NewTicker(gcLifeTimeReassertInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := UpdateGCLifeTime(g.db, g.extended); err != nil {
+				log.Warnf("failed to re-assert tikv_gc_life_time=%s: %s", g.extended, errors.ErrorStack(err))
+			}
+		case <-g.sigCh:
+			log.Warnf("restore interrupted, restoring tikv_gc_life_time=%s before exit", g.original)
+			g.restore()
+			os.Exit(1)
+		case <-g.stopCh:
+			return
+		}
+	}
+}
+
+func (g *GCLifeTimeGuard) restore() {
+	if err := UpdateGCLifeTime(g.db, g.original); err != nil {
+		log.Errorf("failed to restore tikv_gc_life_time=%s: %s", g.original, errors.ErrorStack(err))
+	}
+}
+
+// Close stops the background reassertion loop and restores the original
+// tikv_gc_life_time value. Safe to call more than once.
+func (g *GCLifeTimeGuard) Close() {
+	g.closeOnce.Do(func() {
+		signal.Stop(g.sigCh)
+		close(g.stopCh)
+		<-g.doneCh
+		g.restore()
+	})
+}
+
+// ObtainGCLifeTime reads the current tikv_gc_life_time value.
+func ObtainGCLifeTime(db *sql.DB) (gcLifeTime string, err error) {
+	r := db.QueryRow(
+		"SELECT VARIABLE_VALUE FROM mysql.tidb WHERE VARIABLE_NAME = 'tikv_gc_life_time'")
+	if err = r.Scan(&gcLifeTime); err != nil {
+		return
+	}
+	return
+}
+
+// UpdateGCLifeTime sets tikv_gc_life_time to gcLifeTime.
+func UpdateGCLifeTime(db *sql.DB, gcLifeTime string) error {
+	_, err := db.Exec(
+		"UPDATE mysql.tidb SET VARIABLE_VALUE = ? WHERE VARIABLE_NAME = 'tikv_gc_life_time'", gcLifeTime)
+	return err
+}
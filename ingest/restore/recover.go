@@ -0,0 +1,145 @@
+package restore
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/ddl"
+	"github.com/pingcap/tidb/domain"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/meta"
+	"github.com/pingcap/tidb/model"
+	"github.com/pingcap/tidb/session"
+	"github.com/pingcap/tidb/util/admin"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxHistoryJobsToScan bounds how far back into mysql.tidb_ddl_history we
+// look for a dropped table to recover. A restore only ever needs jobs that
+// happened before the backup's snapshot, so this is generous headroom rather
+// than an exhaustive scan.
+const maxHistoryJobsToScan = 1024
+
+// RecoverTable drives TiDB's recover-table DDL path so a dropped table comes
+// back with its original table ID and allocator state, instead of being
+// re-created from scratch by InitSchema. autoIncID and autoRandID are the
+// table's own auto-increment and auto-random allocator values from just
+// before it was dropped — they are distinct allocators and must not be
+// conflated, or an AUTO_RANDOM table comes back with its auto-random
+// counter silently reset to its auto-increment value. snapshotTS is fixed
+// to the table's own pre-drop state (dropJobID's job.StartTS), not an
+// unrelated backup timestamp, since that's the only snapshot guaranteed to
+// still have this table's data visible.
+func (timgr *TiDBManager) RecoverTable(
+	schemaName, tableName string,
+	tbInfo *model.TableInfo,
+	schemaID, autoIncID, autoRandID, dropJobID int64,
+	snapshotTS uint64,
+) error {
+	se, err := session.CreateSession(timgr.store)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer se.Close()
+
+	recoverInfo := &ddl.RecoverInfo{
+		SchemaID:      schemaID,
+		TableInfo:     tbInfo,
+		DropJobID:     dropJobID,
+		SnapshotTS:    snapshotTS,
+		CurAutoIncID:  autoIncID,
+		CurAutoRandID: autoRandID,
+	}
+
+	d := domain.GetDomain(se).DDL()
+	if err := d.RecoverTable(se, recoverInfo); err != nil {
+		return errors.Trace(err)
+	}
+	log.Infof("recovered table [%s.%s] (id=%d) from dropped job %d at snapshot %d",
+		schemaName, tableName, tbInfo.ID, dropJobID, snapshotTS)
+	return nil
+}
+
+// droppedTableIndex maps "schema.table" (lower-cased) to the most recent
+// ActionDropTable job against that table, built once per InitSchema call
+// instead of re-scanning DDL history for every table in the backup.
+type droppedTableIndex map[string]*model.Job
+
+func droppedTableKey(schemaName, tableName string) string {
+	return strings.ToLower(schemaName) + "." + strings.ToLower(tableName)
+}
+
+// indexDroppedTables scans the DDL job history once and returns the most
+// recent synced ActionDropTable job per schema.table, so InitSchema can look
+// a table up with a single map read instead of re-scanning up to
+// maxHistoryJobsToScan jobs per table. Jobs are not checked against the GC
+// safe point: a job whose pre-drop snapshot GC has already reclaimed is
+// indexed like any other.
+func (timgr *TiDBManager) indexDroppedTables() (droppedTableIndex, error) {
+	txn, err := timgr.store.Begin()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer txn.Rollback()
+
+	jobs, err := admin.GetHistoryDDLJobs(txn, maxHistoryJobsToScan)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	index := make(droppedTableIndex)
+	for _, job := range jobs {
+		if job.Type != model.ActionDropTable || job.State != model.JobStateSynced {
+			continue
+		}
+		if job.BinlogInfo == nil || job.BinlogInfo.TableInfo == nil {
+			continue
+		}
+
+		key := droppedTableKey(job.SchemaName, job.BinlogInfo.TableInfo.Name.O)
+		// GetHistoryDDLJobs does not guarantee ordering, so keep the
+		// highest job ID seen for this table rather than the first match,
+		// or a table dropped, recreated, and dropped again would resurrect
+		// the stale earlier version.
+		if existing, ok := index[key]; !ok || job.ID > existing.ID {
+			index[key] = job
+		}
+	}
+
+	return index, nil
+}
+
+// find looks up the most recent ActionDropTable job against
+// schemaName.tableName, or nil if there isn't one.
+func (index droppedTableIndex) find(schemaName, tableName string) *model.Job {
+	return index[droppedTableKey(schemaName, tableName)]
+}
+
+// allocatorIDsBeforeDrop reads the auto-increment and (if the table uses
+// AUTO_RANDOM) auto-random allocator values the table had right before it
+// was dropped, so RecoverTable can restore both exactly instead of
+// restarting either counter from zero. The two allocators are independent:
+// an AUTO_RANDOM table that only had its auto-increment ID read back would
+// come back with its auto-random counter silently reset.
+func (timgr *TiDBManager) allocatorIDsBeforeDrop(job *model.Job) (autoIncID, autoRandID int64, err error) {
+	snap, err := timgr.store.GetSnapshot(kv.NewVersion(job.StartTS))
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	m := meta.NewSnapshotMeta(snap)
+
+	autoIncID, err = m.GetAutoTableID(job.SchemaID, job.TableID)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+
+	if job.BinlogInfo != nil && job.BinlogInfo.TableInfo != nil && job.BinlogInfo.TableInfo.AutoRandomBits > 0 {
+		autoRandID, err = m.GetAutoRandomID(job.SchemaID, job.TableID)
+		if err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+	}
+
+	return autoIncID, autoRandID, nil
+}
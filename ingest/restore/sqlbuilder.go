@@ -0,0 +1,56 @@
+package restore
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/tidb/model"
+)
+
+// sqlBuilder parses the small, fixed set of schema-bootstrap statements
+// InitSchema needs (CREATE DATABASE / USE) once via parser.Parser, with
+// identifiers quoted and validated up front, instead of interpolating a
+// caller-supplied database name directly into a format string.
+type sqlBuilder struct {
+	parser *parser.Parser
+}
+
+func newSQLBuilder() *sqlBuilder {
+	return &sqlBuilder{parser: parser.New()}
+}
+
+// quoteIdentifier backtick-quotes name for safe use in DDL, doubling any
+// embedded backtick, and rejects names TiDB itself wouldn't accept as an
+// identifier.
+func quoteIdentifier(name string) (string, error) {
+	if !model.IsValidName(name) {
+		return "", errors.Errorf("invalid identifier: %q", name)
+	}
+	return "`" + strings.Replace(name, "`", "``", -1) + "`", nil
+}
+
+func (b *sqlBuilder) createDatabaseStmt(database string) (ast.StmtNode, error) {
+	quoted, err := quoteIdentifier(database)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return b.parseOne("CREATE DATABASE IF NOT EXISTS " + quoted)
+}
+
+func (b *sqlBuilder) useStmt(database string) (ast.StmtNode, error) {
+	quoted, err := quoteIdentifier(database)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return b.parseOne("USE " + quoted)
+}
+
+func (b *sqlBuilder) parseOne(sql string) (ast.StmtNode, error) {
+	stmt, err := b.parser.ParseOneStmt(sql, "", "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return stmt, nil
+}
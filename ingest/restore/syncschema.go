@@ -0,0 +1,98 @@
+package restore
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/model"
+)
+
+// defaultSyncSchemaPollInterval is the fallback cadence SyncSchemaWithContext
+// re-checks the pending table set at, in case a schema-version notification
+// is ever missed; it is a safety net, not the primary wakeup mechanism.
+const defaultSyncSchemaPollInterval = 500 * time.Millisecond
+
+// SyncResult is the outcome of SyncSchemaWithContext: whether every table
+// reached StatePublic, and if not, which ones and why it gave up.
+type SyncResult struct {
+	Ready    bool
+	Pending  []string
+	TimedOut bool
+}
+
+// SyncSchemaOpts configures SyncSchemaWithContext.
+type SyncSchemaOpts struct {
+	// PollInterval is the fallback re-check cadence; defaults to
+	// defaultSyncSchemaPollInterval when zero.
+	PollInterval time.Duration
+}
+
+// SyncSchemaWithContext waits for every table in database to reach
+// StatePublic. Instead of the old fixed 100*5s polling loop — which reloaded
+// the full infoschema on every wakeup regardless of how many tables were
+// actually still pending — it wakes on schema-version bumps published by the
+// DDL owner's schema syncer and, on each wakeup, looks up only the tables
+// still in the pending set (via GetTableByName) rather than reloading the
+// whole database, so cost scales with the pending set rather than with the
+// database's total table count. ctx's deadline bounds the whole wait; on
+// expiry SyncSchemaWithContext returns a result describing what's still
+// pending instead of blocking indefinitely.
+func (timgr *TiDBManager) SyncSchemaWithContext(ctx context.Context, database string, opts SyncSchemaOpts) (*SyncResult, error) {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultSyncSchemaPollInterval
+	}
+
+	dbInfo := timgr.LoadSchemaInfo(database)
+	if dbInfo == nil {
+		return nil, errors.Errorf("database [%s] not found", database)
+	}
+
+	pending := make(map[string]struct{})
+	for name, tbl := range dbInfo.Tables {
+		if !tbl.Available {
+			pending[name] = struct{}{}
+		}
+	}
+	if len(pending) == 0 {
+		return &SyncResult{Ready: true}, nil
+	}
+
+	versionCh := timgr.dom.DDL().SchemaSyncer().GlobalVersionCh()
+
+	ticker := time.NewTicker(opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return pendingResult(pending, true), nil
+		case <-versionCh:
+		case <-ticker.C:
+		}
+
+		for name := range pending {
+			tbl, err := timgr.GetTableByName(database, name)
+			if err != nil {
+				// Table not found yet (or a transient lookup error): leave it
+				// pending and let the next wakeup retry.
+				continue
+			}
+			if tbl.State == model.StatePublic {
+				delete(pending, name)
+			}
+		}
+		if len(pending) == 0 {
+			return &SyncResult{Ready: true}, nil
+		}
+	}
+}
+
+// pendingResult renders the still-pending table names into a SyncResult.
+func pendingResult(pending map[string]struct{}, timedOut bool) *SyncResult {
+	names := make([]string, 0, len(pending))
+	for name := range pending {
+		names = append(names, name)
+	}
+	return &SyncResult{Pending: names, TimedOut: timedOut}
+}
@@ -1,11 +1,7 @@
 package restore
 
 import (
-	"fmt"
 	"strings"
-	"time"
-
-	"database/sql"
 
 	"github.com/juju/errors"
 	"github.com/pingcap/tidb/domain"
@@ -18,6 +14,8 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	goctx "golang.org/x/net/context"
+
+	"github.com/pingcap/br/pkg/storage"
 )
 
 func init() {
@@ -58,6 +56,10 @@ func initKVStorage(pd string) (kv.Storage, *domain.Domain, error) {
 type TiDBManager struct {
 	store kv.Storage
 	dom   *domain.Domain
+
+	// gcGuard is optional: callers that don't pass one take on the
+	// responsibility of managing tikv_gc_life_time themselves.
+	gcGuard *GCLifeTimeGuard
 }
 
 type TidbDBInfo struct {
@@ -77,45 +79,138 @@ type TidbTableInfo struct {
 	core *model.TableInfo
 }
 
-func NewTiDBManager(pdAddr string) (*TiDBManager, error) {
+// NewTiDBManager connects to the cluster behind pdAddr. gcGuard is optional:
+// pass one obtained from NewGCLifeTimeGuard to have Close release it
+// automatically once the manager is done with the cluster.
+func NewTiDBManager(pdAddr string, gcGuard *GCLifeTimeGuard) (*TiDBManager, error) {
 	kvStore, dom, err := initKVStorage(pdAddr)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
 	timgr := &TiDBManager{
-		store: kvStore,
-		dom:   dom,
+		store:   kvStore,
+		dom:     dom,
+		gcGuard: gcGuard,
 	}
 
 	return timgr, nil
 }
 
 func (timgr *TiDBManager) Close() {
+	if timgr.gcGuard != nil {
+		timgr.gcGuard.Close()
+	}
 	timgr.dom.Close()
 	timgr.store.Close()
 }
 
-func (timgr *TiDBManager) InitSchema(database string, tablesSchema map[string]string) error {
+// InitSchema creates the tables described by tablesSchema inside database.
+// For a table whose name matches a synced ActionDropTable job in the DDL
+// history (found by indexDroppedTables, which does not check the GC safe
+// point), it is resurrected via RecoverTable (keeping its original table
+// ID and auto-increment state) instead of being re-created from scratch;
+// every other table falls back to CREATE TABLE IF NOT EXISTS. If
+// tiflashRecorder is non-nil, any "SET TIFLASH REPLICA" trailing a table's
+// DDL (or embedded in a recovered table's meta) is stripped and recorded
+// there instead of being executed, so restore doesn't fail mid-DDL against a
+// cluster whose TiFlash topology differs from the backed-up cluster's; the
+// caller must reapply it (see RestoreTiFlashReplicas) once ingestion
+// finishes. If extStorage is also non-nil, InitSchema persists the recorder
+// there itself (see TiFlashReplicaRecorder.Persist); otherwise it is not
+// persisted.
+//
+// Every statement here is its own auto-committing DDL — TiDB, like MySQL,
+// implicitly commits the current transaction before and after executing
+// CREATE DATABASE/TABLE — so InitSchema cannot roll its work back
+// atomically on failure. Instead, on error it best-effort drops the tables
+// it created earlier in this same call (but never one it recovered via
+// RecoverTable, since that would re-drop data pulled out of GC) so a retried
+// InitSchema doesn't trip over "table already exists".
+func (timgr *TiDBManager) InitSchema(
+	database string, tablesSchema map[string]string,
+	tiflashRecorder *TiFlashReplicaRecorder, extStorage storage.ExternalStorage,
+) error {
 	se, err := session.CreateSession(timgr.store)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	defer se.Close()
 
-	// TODO : all execute in one transaction ?
-
 	ctx := goctx.Background()
 
-	_, err = se.Execute(ctx, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", database))
-	_, err = se.Execute(ctx, fmt.Sprintf("USE %s", database))
+	builder := newSQLBuilder()
+	createDBStmt, err := builder.createDatabaseStmt(database)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	useStmt, err := builder.useStmt(database)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := se.ExecuteStmt(ctx, createDBStmt); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := se.ExecuteStmt(ctx, useStmt); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Built once, not per table: scanning maxHistoryJobsToScan DDL-history
+	// jobs for every table in the backup would be O(tables * history) on
+	// the overwhelmingly common path where nothing was actually dropped.
+	dropIndex, err := timgr.indexDroppedTables()
+	if err != nil {
+		log.Warnf("failed to index dropped tables, falling back to create for all tables: %s",
+			errors.ErrorStack(err))
+		dropIndex = droppedTableIndex{}
+	}
+
+	var created []string
+	for tableName, sqlCreateTable := range tablesSchema {
+		dropJob := dropIndex.find(database, tableName)
+
+		if dropJob != nil {
+			autoIncID, autoRandID, err := timgr.allocatorIDsBeforeDrop(dropJob)
+			if err != nil {
+				timgr.dropTables(ctx, se, database, created)
+				return errors.Trace(err)
+			}
+			tbInfo := dropJob.BinlogInfo.TableInfo
+			if tiflashRecorder != nil {
+				tiflashRecorder.StripAndRecordTableInfo(database, tbInfo)
+			}
+			if err := timgr.RecoverTable(
+				database, tableName, tbInfo,
+				dropJob.SchemaID, autoIncID, autoRandID, dropJob.ID, dropJob.StartTS,
+			); err != nil {
+				timgr.dropTables(ctx, se, database, created)
+				return errors.Trace(err)
+			}
+			continue
+		}
+
+		if tiflashRecorder != nil {
+			sqlCreateTable = tiflashRecorder.StripAndRecord(database, tableName, sqlCreateTable)
+		}
+
+		// CREATE TABLE IF NOT EXISTS also succeeds on a table that was already
+		// there, so only a table absent before this call counts as created.
+		_, lookupErr := timgr.GetTableByName(database, tableName)
+		existedBefore := lookupErr == nil
+
+		if err := safeCreateTable(ctx, se, sqlCreateTable); err != nil {
+			timgr.dropTables(ctx, se, database, created)
+			return errors.Trace(err)
+		}
+		if !existedBefore {
+			created = append(created, tableName)
+		}
+	}
 
-	for _, sqlCreateTable := range tablesSchema {
-		// if _, err = se.Execute(ctx, sqlCreateTable); err != nil {
-		if err = safeCreateTable(ctx, se, sqlCreateTable); err != nil {
+	if tiflashRecorder != nil && extStorage != nil {
+		if err := tiflashRecorder.Persist(ctx, extStorage); err != nil {
+			timgr.dropTables(ctx, se, database, created)
 			return errors.Trace(err)
 		}
 	}
@@ -123,6 +218,28 @@ func (timgr *TiDBManager) InitSchema(database string, tablesSchema map[string]st
 	return nil
 }
 
+// dropTables best-effort drops tables InitSchema created earlier in the same
+// call, after a later table in that call failed. Errors are logged, not
+// returned: this is cleanup on an already-failing path, and the original
+// error is what the caller needs to see.
+func (timgr *TiDBManager) dropTables(ctx goctx.Context, se session.Session, database string, tables []string) {
+	for _, tableName := range tables {
+		quotedDB, err := quoteIdentifier(database)
+		if err != nil {
+			continue
+		}
+		quotedTable, err := quoteIdentifier(tableName)
+		if err != nil {
+			continue
+		}
+		stmt := "DROP TABLE IF EXISTS " + quotedDB + "." + quotedTable
+		if _, err := se.Execute(ctx, stmt); err != nil {
+			log.Errorf("failed to clean up table [%s.%s] after InitSchema failure: %s",
+				database, tableName, errors.ErrorStack(errors.Trace(err)))
+		}
+	}
+}
+
 func toCreateTableIfNotExists(createTable string) string {
 	upCreateTable := strings.ToUpper(createTable)
 	if strings.Index(upCreateTable, "CREATE TABLE IF NOT EXISTS") < 0 {
@@ -200,27 +317,9 @@ func (timgr *TiDBManager) LoadSchemaInfo(database string) *TidbDBInfo {
 	return dbInfo
 }
 
-func (timgr *TiDBManager) SyncSchema(database string) *TidbDBInfo {
-	// TODO : change to timeout ~
-	for i := 0; i < 100; i++ {
-		done := true
-		dbInfo := timgr.LoadSchemaInfo(database)
-		for _, tblInfo := range dbInfo.Tables {
-			if !tblInfo.Available {
-				done = false
-				break
-			}
-		}
-		if !done {
-			log.Warnf("Not all tables ready yet")
-			time.Sleep(time.Second * 5)
-			continue
-		}
-		break
-	}
-
-	return timgr.LoadSchemaInfo(database)
-}
+// SyncSchema is superseded by SyncSchemaWithContext (syncschema.go), which
+// waits on schema-version notifications instead of a fixed polling loop and
+// reports which tables are still pending instead of returning silently.
 
 func (timgr *TiDBManager) GetTableByName(schemaName, tableName string) (*model.TableInfo, error) {
 	infoschema, err := timgr.GetInfoSchema()
@@ -257,17 +356,6 @@ func (tbl *TidbTableInfo) WithAutoIncrPrimaryKey() bool {
 	return false
 }
 
-func ObtainGCLifeTime(db *sql.DB) (gcLifeTime string, err error) {
-	r := db.QueryRow(
-		"SELECT VARIABLE_VALUE FROM mysql.tidb WHERE VARIABLE_NAME = 'tikv_gc_life_time'")
-	if err = r.Scan(&gcLifeTime); err != nil {
-		return
-	}
-	return
-}
-
-func UpdateGCLifeTime(db *sql.DB, gcLifeTime string) error {
-	_, err := db.Exec(fmt.Sprintf(
-		"UPDATE mysql.tidb SET VARIABLE_VALUE = '%s' WHERE VARIABLE_NAME = 'tikv_gc_life_time'", gcLifeTime))
-	return err
-}
+// ObtainGCLifeTime and UpdateGCLifeTime now live in gc.go, where
+// GCLifeTimeGuard builds on them to keep GC disabled for no longer than the
+// restore actually needs it.
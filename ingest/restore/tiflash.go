@@ -0,0 +1,292 @@
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/model"
+	"github.com/pingcap/tidb/session"
+	log "github.com/sirupsen/logrus"
+	goctx "golang.org/x/net/context"
+
+	"github.com/pingcap/br/pkg/storage"
+)
+
+// tiflashReplicaSidecarName is the file written into the backup's external
+// storage recording every table's TiFlash replica setting at backup time.
+const tiflashReplicaSidecarName = "tiflash-replica.json"
+
+// tiflashPollInterval/tiflashPollTimeout bound how long ApplyReplicas waits
+// for PD to report a table's TiFlash replicas as available once requested.
+const (
+	tiflashPollInterval = 5 * time.Second
+	tiflashPollTimeout  = 10 * time.Minute
+)
+
+// TiFlashReplicaInfo is the TiFlash replica configuration a table had at
+// backup time: how many replicas, and which placement-rule location labels
+// they were constrained to.
+type TiFlashReplicaInfo struct {
+	Count          uint64   `json:"count"`
+	LocationLabels []string `json:"location_labels,omitempty"`
+}
+
+// PDStoreInfo is the subset of a PD store's metadata TiFlashReplicaRecorder
+// needs to tell whether the restore target has enough TiFlash capacity.
+type PDStoreInfo struct {
+	Labels map[string]string
+}
+
+// PDClient is the subset of the PD API TiFlashReplicaRecorder depends on.
+type PDClient interface {
+	GetAllStores(ctx context.Context) ([]PDStoreInfo, error)
+}
+
+// TiFlashReplicaRecorder captures the TiFlash replica settings of every
+// table in a backup before InitSchema runs, so the settings can be stripped
+// from the DDL replayed against downstream TiDB (whose TiFlash topology may
+// differ from the backed-up cluster's) and reapplied afterwards once data
+// ingestion has finished.
+type TiFlashReplicaRecorder struct {
+	// "schema.table" -> replica info
+	replicas map[string]*TiFlashReplicaInfo
+}
+
+// NewTiFlashReplicaRecorder returns an empty recorder ready to strip and
+// collect replica settings from a backup's table schemas.
+func NewTiFlashReplicaRecorder() *TiFlashReplicaRecorder {
+	return &TiFlashReplicaRecorder{replicas: make(map[string]*TiFlashReplicaInfo)}
+}
+
+func tiflashReplicaKey(schema, table string) string {
+	return schema + "." + table
+}
+
+var setTiFlashReplicaRe = regexp.MustCompile(
+	`(?is)ALTER\s+TABLE\s+\S+\s+SET\s+TIFLASH\s+REPLICA\s+(\d+)(\s+LOCATION\s+LABELS\s+([^;]+))?\s*;?`)
+
+// StripAndRecord removes any "ALTER TABLE ... SET TIFLASH REPLICA" statement
+// trailing createTable, records the replica count/labels it found (if any)
+// against schema.table, and returns the DDL with that statement removed so
+// safeCreateTable can execute it unconditionally.
+func (r *TiFlashReplicaRecorder) StripAndRecord(schema, table, createTable string) string {
+	m := setTiFlashReplicaRe.FindStringSubmatch(createTable)
+	if m == nil {
+		return createTable
+	}
+
+	info := &TiFlashReplicaInfo{}
+	fmt.Sscanf(m[1], "%d", &info.Count)
+	if m[3] != "" {
+		for _, label := range strings.Split(m[3], ",") {
+			info.LocationLabels = append(info.LocationLabels, strings.Trim(strings.TrimSpace(label), "'\""))
+		}
+	}
+	r.replicas[tiflashReplicaKey(schema, table)] = info
+
+	return setTiFlashReplicaRe.ReplaceAllString(createTable, "")
+}
+
+// StripAndRecordTableInfo does for a recovered table's in-memory meta what
+// StripAndRecord does for a freshly-generated CREATE TABLE's DDL text: it
+// records tbInfo's TiFlashReplica setting against schema.table and clears it
+// on tbInfo, so RecoverTable doesn't hand TiDB a table meta whose embedded
+// replica count can't be satisfied by the restore target. Without this, a
+// table that went through RecoverTable instead of safeCreateTable would
+// keep its original TiFlashReplica setting and could still fail restore on
+// a TiFlash-less cluster — the exact case this recorder exists to prevent.
+func (r *TiFlashReplicaRecorder) StripAndRecordTableInfo(schema string, tbInfo *model.TableInfo) {
+	if tbInfo.TiFlashReplica == nil || tbInfo.TiFlashReplica.Count == 0 {
+		return
+	}
+
+	r.replicas[tiflashReplicaKey(schema, tbInfo.Name.O)] = &TiFlashReplicaInfo{
+		Count:          tbInfo.TiFlashReplica.Count,
+		LocationLabels: tbInfo.TiFlashReplica.LocationLabels,
+	}
+	tbInfo.TiFlashReplica = nil
+}
+
+// Persist writes every recorded replica setting as a JSON sidecar into the
+// backup's external storage, so a later restore attempt (e.g. a retry after
+// a failed run) can reconstruct the recorder via LoadTiFlashReplicaRecorder
+// without needing InitSchema to have run again in the same process.
+func (r *TiFlashReplicaRecorder) Persist(ctx goctx.Context, extStorage storage.ExternalStorage) error {
+	data, err := json.Marshal(r.replicas)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	w, err := extStorage.Create(ctx, tiflashReplicaSidecarName)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := w.Write(ctx, data); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(w.Close(ctx))
+}
+
+// LoadTiFlashReplicaRecorder reconstructs a recorder from the sidecar a
+// previous Persist call wrote, for a restore driver that's retrying
+// RestoreTiFlashReplicas in a new process and so no longer has the
+// in-memory recorder InitSchema built.
+func LoadTiFlashReplicaRecorder(ctx goctx.Context, extStorage storage.ExternalStorage) (*TiFlashReplicaRecorder, error) {
+	reader, err := extStorage.Open(ctx, tiflashReplicaSidecarName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	replicas := make(map[string]*TiFlashReplicaInfo)
+	if err := json.Unmarshal(data, &replicas); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &TiFlashReplicaRecorder{replicas: replicas}, nil
+}
+
+// expectTiFlashStoreCount fails fast with an actionable error if the restore
+// target doesn't have enough TiFlash stores to satisfy want replicas, rather
+// than letting every ALTER TABLE ... SET TIFLASH REPLICA hang forever.
+func expectTiFlashStoreCount(ctx context.Context, pd PDClient, want uint64) error {
+	if want == 0 {
+		return nil
+	}
+
+	stores, err := pd.GetAllStores(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var have uint64
+	for _, s := range stores {
+		if s.Labels["engine"] == "tiflash" {
+			have++
+		}
+	}
+	if have < want {
+		return errors.Errorf(
+			"restore target has %d TiFlash store(s), need at least %d to satisfy the backed-up replica count",
+			have, want)
+	}
+	return nil
+}
+
+// RestoreTiFlashReplicas is the mandatory second half of TiFlash-aware
+// restore started by passing a recorder to InitSchema: once data ingestion
+// for every table InitSchema created or recovered has finished, the restore
+// driver must call this so the replica settings InitSchema stripped are
+// actually reapplied instead of sitting dormant in recorder/the persisted
+// sidecar. A nil recorder is a no-op, so callers that never built one don't
+// need to special-case this call.
+func (timgr *TiDBManager) RestoreTiFlashReplicas(ctx context.Context, recorder *TiFlashReplicaRecorder, pd PDClient) error {
+	if recorder == nil {
+		return nil
+	}
+	return recorder.ApplyReplicas(ctx, timgr, pd)
+}
+
+// ApplyReplicas reissues "ALTER TABLE ... SET TIFLASH REPLICA" for every
+// table this recorder stripped a replica setting from, and polls until PD
+// reports the new replicas as available. Prefer calling this via
+// TiDBManager.RestoreTiFlashReplicas once data ingestion has completed for
+// the affected tables.
+func (r *TiFlashReplicaRecorder) ApplyReplicas(ctx context.Context, timgr *TiDBManager, pd PDClient) error {
+	for key, info := range r.replicas {
+		schema, table := splitTiFlashReplicaKey(key)
+
+		if err := expectTiFlashStoreCount(ctx, pd, info.Count); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := timgr.setTiFlashReplica(ctx, schema, table, info); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := timgr.waitTiFlashReplicaAvailable(ctx, schema, table, info.Count); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func splitTiFlashReplicaKey(key string) (schema, table string) {
+	idx := strings.LastIndex(key, ".")
+	if idx < 0 {
+		return key, ""
+	}
+	return key[:idx], key[idx+1:]
+}
+
+func (timgr *TiDBManager) setTiFlashReplica(ctx context.Context, schema, table string, info *TiFlashReplicaInfo) error {
+	se, err := session.CreateSession(timgr.store)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer se.Close()
+
+	quotedSchema, err := quoteIdentifier(schema)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	quotedTable, err := quoteIdentifier(table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	stmt := fmt.Sprintf("ALTER TABLE %s.%s SET TIFLASH REPLICA %d", quotedSchema, quotedTable, info.Count)
+	if len(info.LocationLabels) > 0 {
+		stmt += fmt.Sprintf(" LOCATION LABELS %s", quoteStringLiterals(info.LocationLabels))
+	}
+
+	if _, err := se.Execute(ctx, stmt); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// quoteStringLiterals renders labels as a comma-separated list of
+// single-quoted SQL string literals, doubling any embedded single quote so
+// a label value can't break out of its literal.
+func quoteStringLiterals(labels []string) string {
+	quoted := make([]string, len(labels))
+	for i, l := range labels {
+		quoted[i] = "'" + strings.Replace(l, "'", "''", -1) + "'"
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func (timgr *TiDBManager) waitTiFlashReplicaAvailable(ctx context.Context, schema, table string, want uint64) error {
+	deadline := time.Now().Add(tiflashPollTimeout)
+	for {
+		tbl, err := timgr.GetTableByName(schema, table)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if tbl.TiFlashReplica != nil && tbl.TiFlashReplica.Available && uint64(tbl.TiFlashReplica.Count) >= want {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return errors.Errorf("timed out waiting for TiFlash replicas of [%s.%s] to become available", schema, table)
+		}
+
+		log.Infof("waiting for TiFlash replicas of [%s.%s] to become available", schema, table)
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case <-time.After(tiflashPollInterval):
+		}
+	}
+}
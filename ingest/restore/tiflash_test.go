@@ -0,0 +1,89 @@
+package restore
+
+import "testing"
+
+func TestStripAndRecord(t *testing.T) {
+	cases := []struct {
+		name        string
+		createTable string
+		wantCount   uint64
+		wantLabels  []string
+		wantStrip   bool
+	}{
+		{
+			name:        "no replica clause",
+			createTable: "CREATE TABLE `t1` (`a` int);",
+			wantStrip:   false,
+		},
+		{
+			name:        "replica without labels",
+			createTable: "CREATE TABLE `t1` (`a` int);\nALTER TABLE `db`.`t1` SET TIFLASH REPLICA 2;",
+			wantCount:   2,
+			wantStrip:   true,
+		},
+		{
+			name:        "replica with single quoted label",
+			createTable: "CREATE TABLE `t1` (`a` int);\nALTER TABLE `db`.`t1` SET TIFLASH REPLICA 1 LOCATION LABELS 'rack';",
+			wantCount:   1,
+			wantLabels:  []string{"rack"},
+			wantStrip:   true,
+		},
+		{
+			name:        "replica with double quoted label",
+			createTable: `CREATE TABLE ` + "`t1`" + ` (` + "`a`" + ` int);` + "\n" + `ALTER TABLE ` + "`db`.`t1`" + ` SET TIFLASH REPLICA 1 LOCATION LABELS "rack";`,
+			wantCount:   1,
+			wantLabels:  []string{"rack"},
+			wantStrip:   true,
+		},
+		{
+			name:        "replica with multiple labels",
+			createTable: "CREATE TABLE `t1` (`a` int);\nALTER TABLE `db`.`t1` SET TIFLASH REPLICA 3 LOCATION LABELS 'rack', 'zone';",
+			wantCount:   3,
+			wantLabels:  []string{"rack", "zone"},
+			wantStrip:   true,
+		},
+		{
+			name:        "replica clause is case-insensitive",
+			createTable: "CREATE TABLE `t1` (`a` int);\nalter table `db`.`t1` set tiflash replica 1;",
+			wantCount:   1,
+			wantStrip:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := NewTiFlashReplicaRecorder()
+			stripped := r.StripAndRecord("db", "t1", c.createTable)
+
+			if c.wantStrip {
+				if stripped == c.createTable {
+					t.Fatalf("expected the TIFLASH REPLICA clause to be stripped, got unchanged DDL: %q", stripped)
+				}
+			} else if stripped != c.createTable {
+				t.Fatalf("expected DDL to be returned unchanged, got %q", stripped)
+			}
+
+			info, recorded := r.replicas[tiflashReplicaKey("db", "t1")]
+			if !c.wantStrip {
+				if recorded {
+					t.Fatalf("did not expect a replica setting to be recorded, got %+v", info)
+				}
+				return
+			}
+			if !recorded {
+				t.Fatalf("expected a replica setting to be recorded")
+			}
+			if info.Count != c.wantCount {
+				t.Errorf("Count = %d, want %d", info.Count, c.wantCount)
+			}
+			if len(info.LocationLabels) != len(c.wantLabels) {
+				t.Fatalf("LocationLabels = %v, want %v", info.LocationLabels, c.wantLabels)
+			}
+			for i, label := range c.wantLabels {
+				if info.LocationLabels[i] != label {
+					t.Errorf("LocationLabels[%d] = %q, want %q", i, info.LocationLabels[i], label)
+				}
+			}
+		})
+	}
+}
@@ -4,59 +4,163 @@ package storage
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"golang.org/x/time/rate"
 )
 
-const burstLimit = 1000 * 1000 * 1000
+// defaultBurstLimit is used when a RateLimitManager is constructed without an
+// explicit burst, matching the previous hard-coded behaviour.
+const defaultBurstLimit = 1000 * 1000 * 1000
 
-type withRatelimit struct {
+// RateLimitManager throttles every writer and reader created from a single
+// ExternalStorage instance against one shared rate.Limiter, so the
+// configured bytes/sec cap is a true aggregate across all concurrent
+// files rather than a per-file allowance. The limiter can be retuned at
+// runtime via SetLimit.
+type RateLimitManager struct {
 	ExternalStorage
-	Ratelimit uint64 // Byte/sec
+	limiter unsafe.Pointer // *rate.Limiter, swapped atomically by SetLimit
 }
 
-// WithRatelimit
-func WithRatelimit(inner ExternalStorage, ratelimit uint64) ExternalStorage {
+// WithRatelimit wraps inner so every Create/Open'd writer and reader shares a
+// single ratelimit-bytes/sec budget with burstLimit burst capacity. A
+// ratelimit of 0 disables throttling entirely and returns inner unchanged.
+func WithRatelimit(inner ExternalStorage, ratelimit, burstLimit uint64) ExternalStorage {
 	if ratelimit == 0 {
 		return inner
 	}
+	if burstLimit == 0 {
+		burstLimit = defaultBurstLimit
+	}
+
+	r := &RateLimitManager{ExternalStorage: inner}
+	atomic.StorePointer(&r.limiter, unsafe.Pointer(newDrainedLimiter(ratelimit, burstLimit)))
+	return r
+}
 
-	s := &withRatelimit{ExternalStorage: inner, Ratelimit: ratelimit}
-	return s
+// newDrainedLimiter builds a rate.Limiter and immediately drains its initial
+// burst, so the bucket starts empty rather than letting the first burst
+// bytes/sec worth of traffic through for free. Without this, the configured
+// cap is only an aggregate after the first burst has been spent once.
+func newDrainedLimiter(bps, burst uint64) *rate.Limiter {
+	limiter := rate.NewLimiter(rate.Limit(bps), int(burst))
+	limiter.AllowN(time.Now(), int(burst))
+	return limiter
 }
 
-func (r *withRatelimit) Create(ctx context.Context, name string) (ExternalFileWriter, error) {
+func (r *RateLimitManager) getLimiter() *rate.Limiter {
+	return (*rate.Limiter)(atomic.LoadPointer(&r.limiter))
+}
+
+// SetLimit atomically swaps the underlying limiter so operators can retune
+// throughput mid-backup (e.g. in response to a signal or an HTTP admin
+// endpoint) without tearing down in-flight writers or readers. The new
+// limiter's burst is drained the same way the original one's was, so
+// retuning can't itself be used to smuggle a fresh burst through.
+func (r *RateLimitManager) SetLimit(newBps uint64) {
+	old := r.getLimiter()
+	burst := uint64(defaultBurstLimit)
+	if old != nil {
+		burst = uint64(old.Burst())
+	}
+	atomic.StorePointer(&r.limiter, unsafe.Pointer(newDrainedLimiter(newBps, burst)))
+}
+
+func (r *RateLimitManager) Create(ctx context.Context, name string) (ExternalFileWriter, error) {
 	inner, err := r.ExternalStorage.Create(ctx, name)
 	if err != nil {
 		return nil, err
 	}
-	w := &withRateLimitWriter{
-		ExternalFileWriter: inner,
-	}
-	if r.Ratelimit > 0 {
-		w.limiter = rate.NewLimiter(rate.Limit(r.Ratelimit), burstLimit)
-		w.limiter.AllowN(time.Now(), burstLimit)
+	return &rateLimitedWriter{ExternalFileWriter: inner, mgr: r}, nil
+}
+
+func (r *RateLimitManager) Open(ctx context.Context, name string) (ExternalFileReader, error) {
+	inner, err := r.ExternalStorage.Open(ctx, name)
+	if err != nil {
+		return nil, err
 	}
-	return w, nil
+	return &rateLimitedReader{ExternalFileReader: inner, mgr: r}, nil
 }
 
-type withRateLimitWriter struct {
+type rateLimitedWriter struct {
 	ExternalFileWriter
-	limiter *rate.Limiter
+	mgr *RateLimitManager
 }
 
-func (rw *withRateLimitWriter) Write(ctx context.Context, p []byte) (int, error) {
-	// do rate limiting here.
-	if rw.limiter == nil {
-		return rw.ExternalFileWriter.Write(ctx, p)
+// Write reserves its byte budget against the shared limiter before handing
+// bytes to the underlying writer, instead of writing first and waiting
+// afterwards. Waiting first means the network layer is never fed more than
+// the limiter allows, so a burst can't slip through ahead of the wait.
+func (w *rateLimitedWriter) Write(ctx context.Context, p []byte) (int, error) {
+	if limiter := w.mgr.getLimiter(); limiter != nil {
+		if err := reserveN(ctx, limiter, len(p)); err != nil {
+			return 0, err
+		}
 	}
-	n, err := rw.ExternalFileWriter.Write(ctx, p)
-	if err != nil {
-		return n, err
-	}
-	if err := rw.limiter.WaitN(ctx, n); err != nil {
-		return n, err
+	return w.ExternalFileWriter.Write(ctx, p)
+}
+
+type rateLimitedReader struct {
+	ExternalFileReader
+	mgr *RateLimitManager
+}
+
+// Read throttles against the same shared limiter used for writes, so
+// restore ingress is throttled symmetrically with backup egress. Unlike
+// Write, the reservation can only be made after the underlying Read
+// returns, because the byte count isn't known beforehand; this is an
+// unavoidable read-then-wait, not an oversight.
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.ExternalFileReader.Read(p)
+	if n > 0 {
+		if limiter := r.mgr.getLimiter(); limiter != nil {
+			if waitErr := reserveN(context.Background(), limiter, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
 	}
 	return n, err
 }
+
+// reserveN blocks until the limiter has budget for n bytes, using Reserve
+// rather than WaitN so the reservation is taken immediately (and can be
+// cancelled) instead of racing other callers between check and wait. n is
+// split into burst-sized chunks: rate.Limiter.ReserveN refuses (ok=false)
+// any single request bigger than the limiter's burst, and silently letting
+// such a request through unthrottled would open a hole for any write/read
+// larger than burst.
+func reserveN(ctx context.Context, limiter *rate.Limiter, n int) error {
+	burst := limiter.Burst()
+	if burst <= 0 {
+		return nil
+	}
+
+	for n > 0 {
+		take := n
+		if take > burst {
+			take = burst
+		}
+
+		rsv := limiter.ReserveN(time.Now(), take)
+		if !rsv.OK() {
+			return nil
+		}
+		if delay := rsv.Delay(); delay > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+				t.Stop()
+			case <-ctx.Done():
+				t.Stop()
+				rsv.Cancel()
+				return ctx.Err()
+			}
+		}
+
+		n -= take
+	}
+	return nil
+}